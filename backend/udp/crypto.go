@@ -0,0 +1,221 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/crypto/chacha20poly1305"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/crypto/hkdf"
+)
+
+// encryptionPSK is a static pre-shared key. encryptionIPsec would negotiate
+// a per-peer key over strongSwan/vici, the way flannel's historical IPsec
+// backend did, but that integration hasn't been written yet.
+const (
+	encryptionPSK   = "psk"
+	encryptionIPsec = "ipsec"
+)
+
+// keySize is the size, in bytes, of the per-peer key handed to the proxy to
+// authenticate and encrypt outgoing frames.
+const keySize = 32
+
+// keyRotationPeriod is how often a peer's derived key changes. The
+// generation fed into deriveLocked is the current Unix time divided by
+// this period rather than a local call counter, so two independently
+// running nodes -- which call rekey at different times and frequencies --
+// still land on the identical key for a given peer address and time
+// window without exchanging any rotation state.
+const keyRotationPeriod = 24 * time.Hour
+
+// keyring holds the per-peer keys derived from the backend's Encryption
+// config. issued is keyed by the peer's address (v4 or v6 -- a peer
+// reachable over both families gets one derived key per family) and exists
+// only so Stop can zero the keys this process has handed out; it holds just
+// the most recent key derived for each address, and a key it replaces is
+// dropped without being zeroed. It's not consulted to compute the next key.
+// aeads caches the AEAD built from the
+// current generation's key so Seal/Open on the same peer within a rotation
+// window don't re-run HKDF and re-schedule ChaCha20-Poly1305 per packet.
+type keyring struct {
+	mu      sync.Mutex
+	psk     []byte
+	ikePort int
+	issued  map[string][]byte
+	aeadGen map[string]uint64
+	aeads   map[string]cipher.AEAD
+}
+
+func newKeyring(typ string, psk []byte, ikePort int) (*keyring, error) {
+	switch typ {
+	case encryptionPSK:
+		if len(psk) == 0 {
+			return nil, fmt.Errorf("encryption: PSK type requires a non-empty PSK")
+		}
+	case encryptionIPsec:
+		// No strongSwan/vici integration exists yet; fail at config time
+		// rather than per-peer once traffic starts flowing.
+		return nil, fmt.Errorf("encryption: ipsec type is not yet implemented, use psk")
+	default:
+		return nil, fmt.Errorf("encryption: unknown type %q", typ)
+	}
+
+	return &keyring{
+		psk:     psk,
+		ikePort: ikePort,
+		issued:  make(map[string][]byte),
+		aeadGen: make(map[string]uint64),
+		aeads:   make(map[string]cipher.AEAD),
+	}, nil
+}
+
+// rekey derives the key for peer in the current rotation window. Calling it
+// again inside the same keyRotationPeriod returns the same bytes; calling it
+// after the window has rolled over returns a new key -- real periodic
+// rotation, without any of the two ends needing to tell the other which
+// generation it's on.
+func (k *keyring) rekey(peer net.IP) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	gen := uint64(time.Now().Unix()) / uint64(keyRotationPeriod/time.Second)
+	key, err := k.deriveLocked(peer, gen)
+	if err != nil {
+		return nil, err
+	}
+	k.issued[peer.String()] = key
+	return key, nil
+}
+
+func (k *keyring) deriveLocked(peer net.IP, gen uint64) ([]byte, error) {
+	if len(k.psk) == 0 {
+		return nil, fmt.Errorf("encryption: no PSK configured, cannot derive key for peer %v", peer)
+	}
+
+	info := make([]byte, 8+len("flannel-udp-backend"))
+	binary.BigEndian.PutUint64(info, gen)
+	copy(info[8:], "flannel-udp-backend")
+
+	r := hkdf.New(sha256.New, k.psk, peer, info)
+	key := make([]byte, keySize)
+	if _, err := r.Read(key); err != nil {
+		return nil, fmt.Errorf("encryption: failed to derive key for peer %v: %v", peer, err)
+	}
+
+	return key, nil
+}
+
+// frameOverhead is how many bytes Seal adds on top of the plaintext: a
+// random nonce plus the ChaCha20-Poly1305 authentication tag.
+const frameOverhead = chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+
+// Seal authenticates and encrypts plaintext under peer's current key,
+// returning nonce||ciphertext||tag ready to write to the UDP socket as-is.
+// Open reverses it on the receiving side. Both get their key through
+// aeadFor, which derives it the same way rekey does, so as long as both ends
+// pass the same peer address and their clocks agree on the rotation window
+// (see keyRotationPeriod) they land on the same key without either side
+// telling the other which generation it used.
+func (k *keyring) Seal(peer net.IP, plaintext []byte) ([]byte, error) {
+	aead, err := k.aeadFor(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("encryption: failed to generate nonce: %v", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open authenticates and decrypts a frame produced by Seal from peer.
+func (k *keyring) Open(peer net.IP, frame []byte) ([]byte, error) {
+	aead, err := k.aeadFor(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(frame) < aead.NonceSize() {
+		return nil, fmt.Errorf("encryption: frame from %v is shorter than a nonce", peer)
+	}
+	nonce, ciphertext := frame[:aead.NonceSize()], frame[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed to authenticate frame from %v: %v", peer, err)
+	}
+	return plaintext, nil
+}
+
+// aeadFor returns the AEAD for peer's key in the current rotation window,
+// reusing the one built last call if the window hasn't rolled over -- Seal
+// and Open are on the per-packet path, and re-running HKDF plus the cipher's
+// key schedule on every packet would be wasted work for a key that's only
+// actually new once every keyRotationPeriod.
+func (k *keyring) aeadFor(peer net.IP) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	gen := uint64(time.Now().Unix()) / uint64(keyRotationPeriod/time.Second)
+	addr := peer.String()
+	if aead, ok := k.aeads[addr]; ok && k.aeadGen[addr] == gen {
+		return aead, nil
+	}
+
+	key, err := k.deriveLocked(peer, gen)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+
+	k.issued[addr] = key
+	k.aeadGen[addr] = gen
+	k.aeads[addr] = aead
+	return aead, nil
+}
+
+// zero wipes the keys held in issued and the PSK, and drops the cached
+// AEADs. Called from UdpBackend.Stop.
+func (k *keyring) zero() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for addr, key := range k.issued {
+		for i := range key {
+			key[i] = 0
+		}
+		delete(k.issued, addr)
+	}
+	for addr := range k.aeads {
+		delete(k.aeads, addr)
+		delete(k.aeadGen, addr)
+	}
+	for i := range k.psk {
+		k.psk[i] = 0
+	}
+}
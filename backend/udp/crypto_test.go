@@ -0,0 +1,142 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *keyring {
+	k, err := newKeyring(encryptionPSK, []byte("super-secret-psk"), 0)
+	if err != nil {
+		t.Fatalf("newKeyring: %v", err)
+	}
+	return k
+}
+
+func TestDeriveLockedIsDeterministicPerGeneration(t *testing.T) {
+	k := newTestKeyring(t)
+	peer := net.ParseIP("192.168.1.10")
+
+	k1, err := k.deriveLocked(peer, 1)
+	if err != nil {
+		t.Fatalf("deriveLocked: %v", err)
+	}
+	k2, err := k.deriveLocked(peer, 1)
+	if err != nil {
+		t.Fatalf("deriveLocked: %v", err)
+	}
+	if !bytes.Equal(k1, k2) {
+		t.Errorf("same (peer, generation) produced different keys: %x vs %x", k1, k2)
+	}
+}
+
+func TestDeriveLockedRotatesAcrossGenerations(t *testing.T) {
+	k := newTestKeyring(t)
+	peer := net.ParseIP("192.168.1.10")
+
+	k1, err := k.deriveLocked(peer, 1)
+	if err != nil {
+		t.Fatalf("deriveLocked: %v", err)
+	}
+	k2, err := k.deriveLocked(peer, 2)
+	if err != nil {
+		t.Fatalf("deriveLocked: %v", err)
+	}
+	if bytes.Equal(k1, k2) {
+		t.Error("different generations produced the same key -- rotation is not happening")
+	}
+}
+
+func TestDeriveLockedDiffersByPeer(t *testing.T) {
+	k := newTestKeyring(t)
+
+	k1, err := k.deriveLocked(net.ParseIP("192.168.1.10"), 1)
+	if err != nil {
+		t.Fatalf("deriveLocked: %v", err)
+	}
+	k2, err := k.deriveLocked(net.ParseIP("192.168.1.11"), 1)
+	if err != nil {
+		t.Fatalf("deriveLocked: %v", err)
+	}
+	if bytes.Equal(k1, k2) {
+		t.Error("two different peers derived the same key")
+	}
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	k := newTestKeyring(t)
+	peer := net.ParseIP("192.168.1.10")
+
+	plaintext := []byte("flannel overlay packet")
+	frame, err := k.Seal(peer, plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	got, err := k.Open(peer, frame)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Open returned %q, want %q", got, plaintext)
+	}
+}
+
+func TestAeadForCachesWithinRotationWindow(t *testing.T) {
+	k := newTestKeyring(t)
+	peer := net.ParseIP("192.168.1.10")
+
+	a1, err := k.aeadFor(peer)
+	if err != nil {
+		t.Fatalf("aeadFor: %v", err)
+	}
+	a2, err := k.aeadFor(peer)
+	if err != nil {
+		t.Fatalf("aeadFor: %v", err)
+	}
+	if a1 != a2 {
+		t.Error("aeadFor built a new AEAD within the same rotation window instead of reusing the cached one")
+	}
+}
+
+func TestOpenRejectsTamperedFrame(t *testing.T) {
+	k := newTestKeyring(t)
+	peer := net.ParseIP("192.168.1.10")
+
+	frame, err := k.Seal(peer, []byte("flannel overlay packet"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	frame[len(frame)-1] ^= 0xff
+
+	if _, err := k.Open(peer, frame); err == nil {
+		t.Error("Open accepted a tampered frame")
+	}
+}
+
+func TestNewKeyringRejectsUnimplementedIPsec(t *testing.T) {
+	if _, err := newKeyring(encryptionIPsec, []byte("psk"), 0); err == nil {
+		t.Error("expected an error configuring the unimplemented ipsec type")
+	}
+}
+
+func TestNewKeyringRejectsEmptyPSK(t *testing.T) {
+	if _, err := newKeyring(encryptionPSK, nil, 0); err == nil {
+		t.Error("expected an error configuring psk encryption with no key material")
+	}
+}
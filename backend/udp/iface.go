@@ -0,0 +1,175 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"net"
+	"time"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// reselectRetryInterval is how long reselectIface waits between Init
+// attempts while the newly selected interface isn't usable yet (e.g. it has
+// a v4 address but IPv6 is enabled and the v6 address hasn't shown up yet).
+const reselectRetryInterval = 5 * time.Second
+
+// watchIface re-initializes the backend whenever the external interface
+// selected via IfaceRegex goes down or changes address, so flannel survives
+// DHCP renewals and interface flaps on laptops/edge nodes without a daemon
+// restart. It only runs when IfaceRegex is configured; the common case of an
+// explicitly-chosen extIface is unaffected.
+func (m *UdpBackend) watchIface() {
+	linkUpd := make(chan netlink.LinkUpdate)
+	addrUpd := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	defer close(done)
+
+	if err := netlink.LinkSubscribe(linkUpd, done); err != nil {
+		log.Error("failed to subscribe to link events: ", err)
+		return
+	}
+	if err := netlink.AddrSubscribe(addrUpd, done); err != nil {
+		log.Error("failed to subscribe to address events: ", err)
+		return
+	}
+
+	for {
+		select {
+		case upd := <-linkUpd:
+			if m.extIface != nil && upd.Attrs().Index == m.extIface.Index && upd.Attrs().OperState != netlink.OperUp {
+				log.Infof("interface %v went down, re-selecting external interface", m.extIface.Name)
+				m.reselectIface()
+				return
+			}
+
+		case upd := <-addrUpd:
+			// Only reselect when an address flannel is actually bound to
+			// (v4 or v6) disappears from the link -- other addresses on the
+			// same interface (secondary aliases, rotating IPv6 privacy
+			// addresses) coming and going shouldn't churn the tunnel.
+			if m.extIface == nil || upd.LinkIndex != m.extIface.Index || upd.NewAddr {
+				continue
+			}
+			if upd.LinkAddress.IP.Equal(m.extIaddr) || (m.extIaddr6 != nil && upd.LinkAddress.IP.Equal(m.extIaddr6)) {
+				log.Infof("address %v removed from %v, re-selecting external interface", upd.LinkAddress.IP, m.extIface.Name)
+				m.reselectIface()
+				return
+			}
+
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// reselectIface stops everything the previous Init/Run started, tears down
+// the UDP socket/TUN/kernel data path, and re-runs Init against whatever
+// interface now matches IfaceRegex, acquiring a fresh lease with the new
+// PublicIP(s). If Init keeps failing (e.g. EnableIPv6 is set but the new
+// interface has no v6 address yet), it retries every reselectRetryInterval
+// instead of giving up and leaving the node with no networking -- giving up
+// here would be worse than the full-daemon-restart behavior this feature
+// replaces.
+//
+// m.mu is held across each attempt (but not across the wait between
+// attempts) so
+// that Stop, which takes the same lock, can never run concurrently with the
+// teardown/Init calls below -- see the comment on m.mu in udp.go.
+func (m *UdpBackend) reselectIface() {
+	m.mu.Lock()
+	// m.ctx is shared by the lease renewer, metrics, and event watcher
+	// goroutines started in Run, and the proxy goroutine is stopped over
+	// m.ctl by teardownDataPath; stop both and wait for them all to exit
+	// before reusing their state, or we'd end up with two copies of each
+	// running against the old and new leases at once.
+	m.cancel()
+	m.teardownDataPath()
+	m.wg.Wait()
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.mu.Unlock()
+
+	for {
+		iface, iaddr, iaddr6, err := m.selectExternalAddrs()
+
+		m.mu.Lock()
+		if m.stopped {
+			m.mu.Unlock()
+			return
+		}
+		ctx := m.ctx
+		if err == nil {
+			if _, err = m.Init(iface, iaddr, iaddr, iaddr6, iaddr6); err == nil {
+				m.mu.Unlock()
+				go m.Run()
+				return
+			}
+			// Init can fail after partially succeeding (e.g. initTun opened
+			// m.tun before ListenUDP or AcquireLease failed); tear down
+			// whatever it did open before retrying, or every failed attempt
+			// leaks a TUN fd/socket.
+			m.teardownDataPath()
+		}
+		m.mu.Unlock()
+
+		log.Error("failed to re-initialize UDP backend on new interface, retrying: ", err)
+
+		select {
+		case <-time.After(reselectRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// teardownDataPath closes whatever sockets/TUN/kernel state the previous
+// Init call set up and clears the keyring, leaving m ready for a fresh Init.
+// It's nil-safe on every field so it can run both on a fully up backend and
+// on the partial state left behind by a failed Init. Callers must hold m.mu.
+func (m *UdpBackend) teardownDataPath() {
+	if m.ctl != nil {
+		stopProxy(m.ctl)
+		m.ctl, m.ctl2 = nil, nil
+	}
+	if m.useKernelDataPath() {
+		m.teardownKernelDataPath()
+	}
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	if m.conn6 != nil {
+		m.conn6.Close()
+		m.conn6 = nil
+	}
+	if m.tun != nil {
+		m.tun.Close()
+		m.tun = nil
+	}
+	if m.keys != nil {
+		m.keys.zero()
+	}
+}
+
+// selectExternalAddrs picks the interface matching IfaceRegex (or the
+// default route interface) along with whichever of its v4/v6 addresses the
+// backend's EnableIPv4/EnableIPv6 config actually needs.
+func (m *UdpBackend) selectExternalAddrs() (*net.Interface, net.IP, net.IP, error) {
+	return ip.GetInterfaceByRegex(m.cfg.IfaceRegex, m.cfg.EnableIPv4, m.cfg.EnableIPv6)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// dataPathKernel selects the in-kernel FOU data path instead of the
+// userspace cproxy. It's opt-in via the backend config's "DataPath" field
+// because it requires FOU support in the running kernel.
+const dataPathKernel = "kernel"
+
+// kernelTunLink is the name of the IPIP-over-FOU tunnel device that carries
+// encapsulated IPv4 traffic once the kernel data path is enabled.
+const kernelTunLink = "flannel-fou"
+
+// kernelTunLink6 is the name of the separate IP6IP6-over-FOU tunnel device
+// that carries encapsulated IPv6 traffic. IPIP (protocol 4) can only carry
+// an IPv4 payload, so a dual-stack kernel data path needs a second device
+// built on protocol 41 (IPv6-in-IPv6) to carry the v6 overlay subnet.
+const kernelTunLink6 = "flannel-fou6"
+
+// kernelPortV6Offset separates the IPv6 FOU listener from the IPv4 one --
+// a single FOU port is bound to exactly one encapsulated protocol, so v4
+// and v6 can't share m.cfg.Port.
+const kernelPortV6Offset = 1
+
+func (m *UdpBackend) useKernelDataPath() bool {
+	return m.cfg.DataPath == dataPathKernel
+}
+
+// initKernelDataPath programs the in-kernel FOU (Foo-over-UDP) tunnel(s)
+// for whichever families are enabled. Once set up, per-peer routes are
+// added directly through netlink in kernelSetRoute/kernelSetRoute6 instead
+// of going through the ctl socketpair and the userspace cproxy.
+func (m *UdpBackend) initKernelDataPath() error {
+	if m.cfg.EnableIPv4 {
+		if err := netlink.FouAdd(netlink.Fou{
+			Port:      m.cfg.Port,
+			Protocol:  4, // IPIP
+			EncapType: netlink.FOU_ENCAP_DIRECT,
+		}); err != nil {
+			return fmt.Errorf("failed to create FOU tunnel on port %d: %v", m.cfg.Port, err)
+		}
+
+		link := &netlink.Iptun{
+			LinkAttrs:  netlink.LinkAttrs{Name: kernelTunLink, MTU: m.mtu},
+			EncapType:  netlink.FOU_ENCAP_DIRECT,
+			EncapDport: uint16(m.cfg.Port),
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return fmt.Errorf("failed to create %v tunnel device: %v", kernelTunLink, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %v up: %v", kernelTunLink, err)
+		}
+	}
+
+	if m.cfg.EnableIPv6 {
+		port6 := m.cfg.Port + kernelPortV6Offset
+		if err := netlink.FouAdd(netlink.Fou{
+			Port:      port6,
+			Protocol:  41, // IPv6-in-IPv6
+			EncapType: netlink.FOU_ENCAP_DIRECT,
+		}); err != nil {
+			return fmt.Errorf("failed to create IPv6 FOU tunnel on port %d: %v", port6, err)
+		}
+
+		link6 := &netlink.Ip6tnl{
+			LinkAttrs:  netlink.LinkAttrs{Name: kernelTunLink6, MTU: m.mtu},
+			EncapType:  netlink.FOU_ENCAP_DIRECT,
+			EncapDport: uint16(port6),
+		}
+		if err := netlink.LinkAdd(link6); err != nil {
+			return fmt.Errorf("failed to create %v tunnel device: %v", kernelTunLink6, err)
+		}
+		if err := netlink.LinkSetUp(link6); err != nil {
+			return fmt.Errorf("failed to set %v up: %v", kernelTunLink6, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *UdpBackend) teardownKernelDataPath() {
+	if m.cfg.EnableIPv4 {
+		teardownKernelTunLink(kernelTunLink)
+		if err := netlink.FouDel(netlink.Fou{Port: m.cfg.Port, Protocol: 4}); err != nil {
+			log.Error("failed to delete FOU port ", m.cfg.Port, ": ", err)
+		}
+	}
+	if m.cfg.EnableIPv6 {
+		teardownKernelTunLink(kernelTunLink6)
+		port6 := m.cfg.Port + kernelPortV6Offset
+		if err := netlink.FouDel(netlink.Fou{Port: port6, Protocol: 41}); err != nil {
+			log.Error("failed to delete FOU port ", port6, ": ", err)
+		}
+	}
+}
+
+func teardownKernelTunLink(name string) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		log.Error("failed to look up ", name, " during teardown: ", err)
+		return
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		log.Error("failed to delete ", name, ": ", err)
+	}
+}
+
+// kernelSetRoute programs a route for a remote subnet directly on the FOU
+// tunnel device, bypassing the ctl channel entirely.
+func (m *UdpBackend) kernelSetRoute(sn ip.IP4Net, publicIP ip.IP4) error {
+	link, err := netlink.LinkByName(kernelTunLink)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %v: %v", kernelTunLink, err)
+	}
+
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn.ToIPNet(),
+		Gw:        publicIP.ToIP(),
+	})
+}
+
+func (m *UdpBackend) kernelRemoveRoute(sn ip.IP4Net) error {
+	link, err := netlink.LinkByName(kernelTunLink)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %v: %v", kernelTunLink, err)
+	}
+
+	return netlink.RouteDel(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn.ToIPNet(),
+	})
+}
+
+// kernelSetRoute6 and kernelRemoveRoute6 mirror kernelSetRoute/
+// kernelRemoveRoute for the IPv6 overlay subnet, routed over kernelTunLink6
+// (not kernelTunLink -- IPIP can't carry an IPv6 payload) so DataPath:
+// "kernel" carries dual-stack traffic the same way the userspace proxy does.
+func (m *UdpBackend) kernelSetRoute6(sn6 *net.IPNet, publicIP6 net.IP) error {
+	link, err := netlink.LinkByName(kernelTunLink6)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %v: %v", kernelTunLink6, err)
+	}
+
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn6,
+		Gw:        publicIP6,
+	})
+}
+
+func (m *UdpBackend) kernelRemoveRoute6(sn6 *net.IPNet) error {
+	link, err := netlink.LinkByName(kernelTunLink6)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %v: %v", kernelTunLink6, err)
+	}
+
+	return netlink.RouteDel(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn6,
+	})
+}
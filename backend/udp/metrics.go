@@ -0,0 +1,179 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/coreos/flannel/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/coreos/flannel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// peerStats are the counters tracked per remote PublicIP.
+type peerStats struct {
+	packetsTx  uint64
+	packetsRx  uint64
+	bytesTx    uint64
+	bytesRx    uint64
+	encapDrops uint64
+}
+
+// metrics tracks the counters exposed on MetricsAddr. Per-peer counters are
+// updated with atomic operations on the shared peerStats so they can be
+// touched from the proxy goroutines without a lock; the peers map itself is
+// guarded by mu since peers are added as leases come and go.
+type metrics struct {
+	mu    sync.Mutex
+	peers map[string]*peerStats
+
+	leaseRenewals uint64
+	routes        int64 // current subnet->PublicIP route table size
+
+	renewerRunning int32 // 1 while the LeaseRenewer goroutine is alive
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		peers:          make(map[string]*peerStats),
+		renewerRunning: 1,
+	}
+}
+
+// peer returns (creating if necessary) the counters for a remote PublicIP.
+func (mt *metrics) peer(addr string) *peerStats {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	p, ok := mt.peers[addr]
+	if !ok {
+		p = &peerStats{}
+		mt.peers[addr] = p
+	}
+	return p
+}
+
+func (mt *metrics) addPacketsTx(peer string, n, bytes uint64) {
+	p := mt.peer(peer)
+	atomic.AddUint64(&p.packetsTx, n)
+	atomic.AddUint64(&p.bytesTx, bytes)
+}
+
+func (mt *metrics) addPacketsRx(peer string, n, bytes uint64) {
+	p := mt.peer(peer)
+	atomic.AddUint64(&p.packetsRx, n)
+	atomic.AddUint64(&p.bytesRx, bytes)
+}
+
+func (mt *metrics) incEncapDrops(peer string) {
+	atomic.AddUint64(&mt.peer(peer).encapDrops, 1)
+}
+
+func (mt *metrics) incRoutes(delta int64) { atomic.AddInt64(&mt.routes, delta) }
+func (mt *metrics) incLeaseRenewal()      { atomic.AddUint64(&mt.leaseRenewals, 1) }
+func (mt *metrics) renewerStarted()       { atomic.StoreInt32(&mt.renewerRunning, 1) }
+func (mt *metrics) renewerStopped()       { atomic.StoreInt32(&mt.renewerRunning, 0) }
+func (mt *metrics) renewerIsProgressing() bool {
+	return atomic.LoadInt32(&mt.renewerRunning) == 1
+}
+
+func (mt *metrics) writeTo(w http.ResponseWriter) {
+	mt.mu.Lock()
+	peers := make(map[string]*peerStats, len(mt.peers))
+	for addr, p := range mt.peers {
+		peers[addr] = p
+	}
+	mt.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP flannel_udp_packets_tx_total Packets sent on the encapsulation socket, by peer.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_packets_tx_total counter")
+	for addr, p := range peers {
+		fmt.Fprintf(w, "flannel_udp_packets_tx_total{peer=%q} %d\n", addr, atomic.LoadUint64(&p.packetsTx))
+	}
+
+	fmt.Fprintln(w, "# HELP flannel_udp_packets_rx_total Packets received on the encapsulation socket, by peer.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_packets_rx_total counter")
+	for addr, p := range peers {
+		fmt.Fprintf(w, "flannel_udp_packets_rx_total{peer=%q} %d\n", addr, atomic.LoadUint64(&p.packetsRx))
+	}
+
+	fmt.Fprintln(w, "# HELP flannel_udp_bytes_tx_total Bytes sent on the encapsulation socket, by peer.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_bytes_tx_total counter")
+	for addr, p := range peers {
+		fmt.Fprintf(w, "flannel_udp_bytes_tx_total{peer=%q} %d\n", addr, atomic.LoadUint64(&p.bytesTx))
+	}
+
+	fmt.Fprintln(w, "# HELP flannel_udp_bytes_rx_total Bytes received on the encapsulation socket, by peer.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_bytes_rx_total counter")
+	for addr, p := range peers {
+		fmt.Fprintf(w, "flannel_udp_bytes_rx_total{peer=%q} %d\n", addr, atomic.LoadUint64(&p.bytesRx))
+	}
+
+	fmt.Fprintln(w, "# HELP flannel_udp_encap_drops_total Packets dropped during encap/decap, by peer.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_encap_drops_total counter")
+	for addr, p := range peers {
+		fmt.Fprintf(w, "flannel_udp_encap_drops_total{peer=%q} %d\n", addr, atomic.LoadUint64(&p.encapDrops))
+	}
+
+	fmt.Fprintln(w, "# HELP flannel_udp_lease_renewals_total Successful renewals of this node's own lease.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_lease_renewals_total counter")
+	fmt.Fprintf(w, "flannel_udp_lease_renewals_total %d\n", atomic.LoadUint64(&mt.leaseRenewals))
+
+	fmt.Fprintln(w, "# HELP flannel_udp_routes Current number of subnet routes installed.")
+	fmt.Fprintln(w, "# TYPE flannel_udp_routes gauge")
+	fmt.Fprintf(w, "flannel_udp_routes %d\n", atomic.LoadInt64(&mt.routes))
+}
+
+// serveMetrics starts the optional /metrics and /healthz HTTP listener and
+// blocks until ctx is canceled, at which point it shuts the listener down.
+// Callers track it with m.wg like the other backend goroutines so Stop()
+// actually waits for it to go away instead of leaking it across a
+// reselectIface-driven restart.
+func (m *UdpBackend) serveMetrics(ctx context.Context) {
+	if m.cfg.MetricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		m.metrics.writeTo(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !m.metrics.renewerIsProgressing() {
+			http.Error(w, "lease renewer has exited", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	ln, err := net.Listen("tcp", m.cfg.MetricsAddr)
+	if err != nil {
+		log.Error("failed to start metrics listener: ", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	log.Info("Serving backend metrics on ", m.cfg.MetricsAddr)
+	if err := http.Serve(ln, mux); err != nil {
+		log.Info("metrics listener stopped: ", err)
+	}
+}
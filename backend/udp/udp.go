@@ -32,8 +32,9 @@ import (
 )
 
 const (
-	encapOverhead = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
-	defaultPort   = 8285
+	encapOverhead   = 28 // 20 bytes IPv4 hdr + 8 bytes UDP hdr
+	encapOverheadV6 = 48 // 40 bytes IPv6 hdr + 8 bytes UDP hdr
+	defaultPort     = 8285
 )
 
 type UdpBackend struct {
@@ -41,18 +42,43 @@ type UdpBackend struct {
 	network string
 	config  *subnet.Config
 	cfg     struct {
-		Port int
+		Port       int
+		EnableIPv4 bool
+		EnableIPv6 bool
+		DataPath   string
+		Encryption *struct {
+			Type    string
+			PSK     string
+			IKEPort int
+		}
+		MetricsAddr string
+		IfaceRegex  string
 	}
-	lease  *subnet.Lease
-	ctl    *os.File
-	ctl2   *os.File
-	tun    *os.File
-	conn   *net.UDPConn
-	mtu    int
-	tunNet ip.IP4Net
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	keys      *keyring
+	metrics   *metrics
+	extIface  *net.Interface
+	extIaddr  net.IP
+	extIaddr6 net.IP
+	lease     *subnet.Lease
+	ctl       *os.File
+	ctl2      *os.File
+	tun       *os.File
+	conn      *net.UDPConn
+	conn6     *net.UDPConn
+	mtu       int
+	tunNet    ip.IP4Net
+	tunNet6   *net.IPNet
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+
+	// mu guards ctl/ctl2/tun/conn/conn6/keys/ctx/cancel/stopped against the
+	// two goroutines that can mutate them after Run has started: Stop (called
+	// by whatever owns the backend) and reselectIface (called from the
+	// watchIface goroutine). Without it, a Stop racing a reselect could close
+	// an already-nil'd ctl, double-zero a freed key, or fire a stale cancel.
+	mu      sync.Mutex
+	stopped bool
 }
 
 func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backend {
@@ -66,10 +92,15 @@ func New(sm subnet.Manager, network string, config *subnet.Config) backend.Backe
 		cancel:  cancel,
 	}
 	be.cfg.Port = defaultPort
+	be.metrics = newMetrics()
+	// Default to the historical IPv4-only behavior; the backend config can
+	// turn on IPv6 (and optionally turn off IPv4) to run dual-stack or
+	// single-stack v6.
+	be.cfg.EnableIPv4 = true
 	return &be
 }
 
-func (m *UdpBackend) Init(extIface *net.Interface, extIaddr net.IP, extEaddr net.IP) (*backend.SubnetDef, error) {
+func (m *UdpBackend) Init(extIface *net.Interface, extIaddr net.IP, extEaddr net.IP, extIaddr6 net.IP, extEaddr6 net.IP) (*backend.SubnetDef, error) {
 	// Parse our configuration
 	if len(m.config.Backend) > 0 {
 		if err := json.Unmarshal(m.config.Backend, &m.cfg); err != nil {
@@ -77,9 +108,39 @@ func (m *UdpBackend) Init(extIface *net.Interface, extIaddr net.IP, extEaddr net
 		}
 	}
 
+	if !m.cfg.EnableIPv4 && !m.cfg.EnableIPv6 {
+		return nil, fmt.Errorf("UDP backend: at least one of EnableIPv4 or EnableIPv6 must be set")
+	}
+	if m.cfg.EnableIPv6 && extEaddr6 == nil {
+		return nil, fmt.Errorf("UDP backend: EnableIPv6 is set but no IPv6 external address was found")
+	}
+
+	m.extIface = extIface
+	m.extIaddr = extIaddr
+	m.extIaddr6 = extIaddr6
+
+	if m.cfg.Encryption != nil {
+		if m.useKernelDataPath() {
+			// The kernel FOU tunnel forwards frames as plain IPIP/IP6IP6
+			// packets; there's nowhere in that path to apply Encryption, so
+			// fail at config time instead of silently shipping plaintext.
+			return nil, fmt.Errorf("UDP backend: Encryption is not supported with DataPath %q", m.cfg.DataPath)
+		}
+
+		var err error
+		m.keys, err = newKeyring(m.cfg.Encryption.Type, []byte(m.cfg.Encryption.PSK), m.cfg.Encryption.IKEPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up encryption: %v", err)
+		}
+	}
+
 	// Acquire the lease form subnet manager
-	attrs := subnet.LeaseAttrs{
-		PublicIP: ip.FromIP(extEaddr),
+	attrs := subnet.LeaseAttrs{}
+	if m.cfg.EnableIPv4 {
+		attrs.PublicIP = ip.FromIP(extEaddr)
+	}
+	if m.cfg.EnableIPv6 {
+		attrs.PublicIPv6 = extEaddr6
 	}
 
 	l, err := m.sm.AcquireLease(m.ctx, m.network, &attrs)
@@ -96,26 +157,76 @@ func (m *UdpBackend) Init(extIface *net.Interface, extIaddr net.IP, extEaddr net
 
 	// Tunnel's subnet is that of the whole overlay network (e.g. /16)
 	// and not that of the individual host (e.g. /24)
-	m.tunNet = ip.IP4Net{
-		IP:        l.Subnet.IP,
-		PrefixLen: m.config.Network.PrefixLen,
+	if m.cfg.EnableIPv4 {
+		m.tunNet = ip.IP4Net{
+			IP:        l.Subnet.IP,
+			PrefixLen: m.config.Network.PrefixLen,
+		}
 	}
-
-	// TUN MTU will be smaller b/c of encap (IP+UDP hdrs)
-	m.mtu = extIface.MTU - encapOverhead
-
-	if err = m.initTun(); err != nil {
-		return nil, err
+	if m.cfg.EnableIPv6 && l.Subnet6 != nil {
+		m.tunNet6 = &net.IPNet{
+			IP:   l.Subnet6.IP,
+			Mask: net.CIDRMask(m.config.Network6.PrefixLen, 128),
+		}
 	}
 
-	m.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: extIaddr, Port: m.cfg.Port})
-	if err != nil {
-		return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
+	// TUN MTU will be smaller b/c of encap (IP+UDP hdrs). A dual-stack
+	// tunnel has to budget for the larger of the two encap overheads so
+	// the same MTU works for both families.
+	overhead := 0
+	if m.cfg.EnableIPv4 {
+		overhead = encapOverhead
+	}
+	if m.cfg.EnableIPv6 && encapOverheadV6 > overhead {
+		overhead = encapOverheadV6
+	}
+	if m.keys != nil {
+		// Sealed frames carry a nonce and auth tag on top of the plaintext;
+		// budget for that too or encrypted packets near the tunnel MTU will
+		// come out larger than the interface can carry unfragmented.
+		overhead += frameOverhead
+	}
+	m.mtu = extIface.MTU - overhead
+
+	if m.useKernelDataPath() {
+		if err = m.initKernelDataPath(); err != nil {
+			log.Warning("kernel data path unavailable, falling back to userspace proxy: ", err)
+			// initKernelDataPath can fail after partially succeeding (e.g. the
+			// v4 FOU tunnel came up but the v6 one didn't); tear down
+			// whichever links it did create, or the failed half leaks on the
+			// host for good now that DataPath is about to be cleared below.
+			m.teardownKernelDataPath()
+			// Clear DataPath so useKernelDataPath() reports false until the
+			// next Init re-reads the backend config (as reselectIface does);
+			// Run/Stop/processSubnetEvents all key off it, not just this one
+			// call site.
+			m.cfg.DataPath = ""
+		}
 	}
 
-	m.ctl, m.ctl2, err = newCtlSockets()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create control socket: %v", err)
+	if !m.useKernelDataPath() {
+		if err = m.initTun(); err != nil {
+			return nil, err
+		}
+
+		if m.cfg.EnableIPv4 {
+			m.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: extIaddr, Port: m.cfg.Port})
+			if err != nil {
+				return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
+			}
+		}
+
+		if m.cfg.EnableIPv6 {
+			m.conn6, err = net.ListenUDP("udp6", &net.UDPAddr{IP: extIaddr6, Port: m.cfg.Port})
+			if err != nil {
+				return nil, fmt.Errorf("failed to start listening on UDPv6 socket: %v", err)
+			}
+		}
+
+		m.ctl, m.ctl2, err = newCtlSockets()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create control socket: %v", err)
+		}
 	}
 
 	return &backend.SubnetDef{
@@ -126,28 +237,59 @@ func (m *UdpBackend) Init(extIface *net.Interface, extIaddr net.IP, extEaddr net
 
 func (m *UdpBackend) Run() {
 	// one for each goroutine below
-	m.wg.Add(2)
+	m.wg.Add(3)
 
+	if m.useKernelDataPath() {
+		// The kernel FOU tunnel forwards packets entirely in-kernel;
+		// there is no userspace proxy goroutine to start.
+		m.wg.Done()
+	} else {
+		// The proxy needs the tunnel's own address in each enabled family so
+		// it knows what to put in the encapsulated packets' source field;
+		// tunNet6 is nil whenever EnableIPv6 is off or the lease has no v6
+		// subnet yet, in which case there's nothing to hand it for v6.
+		var tunIP6 net.IP
+		if m.tunNet6 != nil {
+			tunIP6 = m.tunNet6.IP
+		}
+		go func() {
+			runCProxy(m.tun, m.conn, m.conn6, m.ctl2, m.tunNet.IP, tunIP6, m.mtu, m.metrics)
+			m.wg.Done()
+		}()
+	}
+
+	// Run starts again after every reselectIface, so mark the new renewer
+	// as running in case the previous one already reported itself stopped.
+	m.metrics.renewerStarted()
 	go func() {
-		runCProxy(m.tun, m.conn, m.ctl2, m.tunNet.IP, m.mtu)
+		subnet.LeaseRenewer(m.ctx, m.sm, m.network, m.lease)
+		m.metrics.renewerStopped()
 		m.wg.Done()
 	}()
 
 	go func() {
-		subnet.LeaseRenewer(m.ctx, m.sm, m.network, m.lease)
+		m.serveMetrics(m.ctx)
 		m.wg.Done()
 	}()
 
+	if m.cfg.IfaceRegex != "" {
+		go m.watchIface()
+	}
+
 	m.monitorEvents()
 
 	m.wg.Wait()
 }
 
 func (m *UdpBackend) Stop() {
-	if m.ctl != nil {
-		stopProxy(m.ctl)
-	}
-
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Setting stopped under the same lock reselectIface checks it with means
+	// a reselect that's mid-retry gives up instead of racing this teardown
+	// with one of its own Init/teardownDataPath calls.
+	m.stopped = true
+	m.teardownDataPath()
 	m.cancel()
 }
 
@@ -175,7 +317,7 @@ func (m *UdpBackend) initTun() error {
 		return fmt.Errorf("Failed to open TUN device: %v", err)
 	}
 
-	err = configureIface(tunName, m.tunNet, m.mtu)
+	err = configureIface(tunName, m.tunNet, m.tunNet6, m.mtu)
 	if err != nil {
 		return err
 	}
@@ -183,15 +325,24 @@ func (m *UdpBackend) initTun() error {
 	return nil
 }
 
-func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
+func configureIface(ifname string, ipn ip.IP4Net, ipn6 *net.IPNet, mtu int) error {
 	iface, err := netlink.LinkByName(ifname)
 	if err != nil {
 		return fmt.Errorf("failed to lookup interface %v", ifname)
 	}
 
-	err = netlink.AddrAdd(iface, &netlink.Addr{ipn.ToIPNet(), ""})
-	if err != nil {
-		return fmt.Errorf("failed to add IP address %v to %v: %v", ipn.String(), ifname, err)
+	if ipn.IP != 0 {
+		err = netlink.AddrAdd(iface, &netlink.Addr{ipn.ToIPNet(), ""})
+		if err != nil {
+			return fmt.Errorf("failed to add IP address %v to %v: %v", ipn.String(), ifname, err)
+		}
+	}
+
+	if ipn6 != nil {
+		err = netlink.AddrAdd(iface, &netlink.Addr{ipn6, ""})
+		if err != nil {
+			return fmt.Errorf("failed to add IPv6 address %v to %v: %v", ipn6.String(), ifname, err)
+		}
 	}
 
 	err = netlink.LinkSetMTU(iface, mtu)
@@ -206,13 +357,26 @@ func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
 
 	// explicitly add a route since there might be a route for a subnet already
 	// installed by Docker and then it won't get auto added
-	err = netlink.RouteAdd(&netlink.Route{
-		LinkIndex: iface.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       ipn.Network().ToIPNet(),
-	})
-	if err != nil && err != syscall.EEXIST {
-		return fmt.Errorf("Failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
+	if ipn.IP != 0 {
+		err = netlink.RouteAdd(&netlink.Route{
+			LinkIndex: iface.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       ipn.Network().ToIPNet(),
+		})
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("Failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
+		}
+	}
+
+	if ipn6 != nil {
+		err = netlink.RouteAdd(&netlink.Route{
+			LinkIndex: iface.Attrs().Index,
+			Scope:     netlink.SCOPE_UNIVERSE,
+			Dst:       &net.IPNet{IP: ipn6.IP.Mask(ipn6.Mask), Mask: ipn6.Mask},
+		})
+		if err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("Failed to add IPv6 route (%v -> %v): %v", ipn6.String(), ifname, err)
+		}
 	}
 
 	return nil
@@ -225,7 +389,12 @@ func (m *UdpBackend) monitorEvents() {
 
 	m.wg.Add(1)
 	go func() {
-		subnet.WatchLeases(m.ctx, m.sm, m.network, m.lease, evts)
+		// Passing nil instead of m.lease here means WatchLeases does not
+		// filter our own lease's events back out before they reach evts --
+		// we need those to reach processSubnetEvents' SubnetAdded case
+		// below, which tells them apart from peer leases itself and uses
+		// them to drive the lease-renewal metric.
+		subnet.WatchLeases(m.ctx, m.sm, m.network, nil, evts)
 		m.wg.Done()
 	}()
 
@@ -240,18 +409,97 @@ func (m *UdpBackend) monitorEvents() {
 	}
 }
 
+// family identifies which IP version a route or encap socket applies to, so
+// the single ctl channel can carry routes for both udp4 and udp6 sockets.
+type family int
+
+const (
+	familyV4 family = iota
+	familyV6
+)
+
 func (m *UdpBackend) processSubnetEvents(batch []subnet.Event) {
 	for _, evt := range batch {
 		switch evt.Type {
 		case subnet.SubnetAdded:
 			log.Info("Subnet added: ", evt.Lease.Subnet)
 
-			setRoute(m.ctl, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, m.cfg.Port)
+			if evt.Lease.Subnet.String() == m.lease.Subnet.String() {
+				// WatchLeases echoes our own lease back on renewal; this
+				// isn't a new peer, just a sign the renewer is progressing.
+				m.metrics.incLeaseRenewal()
+				continue
+			}
+
+			m.metrics.incRoutes(1)
+
+			if m.useKernelDataPath() {
+				if m.cfg.EnableIPv4 {
+					if err := m.kernelSetRoute(evt.Lease.Subnet, evt.Lease.Attrs.PublicIP); err != nil {
+						log.Error("failed to add kernel route: ", err)
+					}
+				}
+				if m.cfg.EnableIPv6 && evt.Lease.Subnet6 != nil && evt.Lease.Attrs.PublicIPv6 != nil {
+					if err := m.kernelSetRoute6(evt.Lease.Subnet6, evt.Lease.Attrs.PublicIPv6); err != nil {
+						log.Error("failed to add IPv6 kernel route: ", err)
+					}
+				}
+				continue
+			}
+
+			var keyV4, keyV6 []byte
+			if m.keys != nil {
+				// Re-deriving on every SubnetAdded (including lease renewal
+				// re-events) rekeys the peer rather than pinning one key
+				// for the lifetime of the process. v4 and v6 are distinct
+				// addresses for the same peer, so each gets its own key.
+				if m.cfg.EnableIPv4 {
+					if k, err := m.keys.rekey(evt.Lease.Attrs.PublicIP.ToIP()); err != nil {
+						log.Error("failed to derive IPv4 key for peer: ", err)
+					} else {
+						keyV4 = k
+					}
+				}
+				if m.cfg.EnableIPv6 && evt.Lease.Attrs.PublicIPv6 != nil {
+					if k, err := m.keys.rekey(evt.Lease.Attrs.PublicIPv6); err != nil {
+						log.Error("failed to derive IPv6 key for peer: ", err)
+					} else {
+						keyV6 = k
+					}
+				}
+			}
+
+			if m.cfg.EnableIPv4 {
+				setRoute(m.ctl, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, m.cfg.Port, familyV4, keyV4)
+			}
+			if m.cfg.EnableIPv6 && evt.Lease.Attrs.PublicIPv6 != nil {
+				setRoute(m.ctl, evt.Lease.Subnet, evt.Lease.Attrs.PublicIPv6, m.cfg.Port, familyV6, keyV6)
+			}
 
 		case subnet.SubnetRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
-
-			removeRoute(m.ctl, evt.Lease.Subnet)
+			m.metrics.incRoutes(-1)
+
+			if m.useKernelDataPath() {
+				if m.cfg.EnableIPv4 {
+					if err := m.kernelRemoveRoute(evt.Lease.Subnet); err != nil {
+						log.Error("failed to remove kernel route: ", err)
+					}
+				}
+				if m.cfg.EnableIPv6 && evt.Lease.Subnet6 != nil {
+					if err := m.kernelRemoveRoute6(evt.Lease.Subnet6); err != nil {
+						log.Error("failed to remove IPv6 kernel route: ", err)
+					}
+				}
+				continue
+			}
+
+			if m.cfg.EnableIPv4 {
+				removeRoute(m.ctl, evt.Lease.Subnet, familyV4)
+			}
+			if m.cfg.EnableIPv6 && evt.Lease.Attrs.PublicIPv6 != nil {
+				removeRoute(m.ctl, evt.Lease.Subnet, familyV6)
+			}
 
 		default:
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
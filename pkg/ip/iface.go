@@ -0,0 +1,136 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/coreos/flannel/Godeps/_workspace/src/github.com/vishvananda/netlink"
+)
+
+// GetInterfaceByRegex returns the first network interface (and its external
+// addresses) whose name matches re, in the order net.Interfaces() returns
+// them. wantV4/wantV6 say which address families the caller actually needs;
+// an interface only matches if it has a usable address in every family
+// requested, and the address for a family that wasn't requested comes back
+// nil. If re is empty or matches nothing, it falls back to the interface
+// holding the default route for the lowest-numbered family requested, the
+// way flanneld behaves when no --iface is given.
+func GetInterfaceByRegex(re string, wantV4, wantV6 bool) (*net.Interface, net.IP, net.IP, error) {
+	if re != "" {
+		pattern, err := regexp.Compile(re)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid interface regex %q: %v", re, err)
+		}
+
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to list interfaces: %v", err)
+		}
+
+		for i := range ifaces {
+			iface := &ifaces[i]
+			if !pattern.MatchString(iface.Name) {
+				continue
+			}
+
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+
+			v4, v6, err := usableAddrs(addrs, wantV4, wantV6)
+			if err != nil {
+				continue
+			}
+			return iface, v4, v6, nil
+		}
+	}
+
+	return getDefaultRouteInterface(wantV4, wantV6)
+}
+
+// usableAddrs picks a non-loopback IPv4 and/or global-unicast IPv6 address
+// out of addrs, and is the part of interface selection that's actually
+// error-prone enough to need its own tests -- kept free of any OS/netlink
+// calls so it can be exercised with synthetic addresses.
+func usableAddrs(addrs []net.Addr, wantV4, wantV6 bool) (net.IP, net.IP, error) {
+	var v4, v6 net.IP
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			if v4 == nil {
+				v4 = ip4
+			}
+		} else if v6 == nil && ipnet.IP.IsGlobalUnicast() {
+			v6 = ipnet.IP
+		}
+	}
+
+	if wantV4 && v4 == nil {
+		return nil, nil, fmt.Errorf("no usable IPv4 address")
+	}
+	if wantV6 && v6 == nil {
+		return nil, nil, fmt.Errorf("no usable IPv6 address")
+	}
+	return v4, v6, nil
+}
+
+// getDefaultRouteInterface returns the interface carrying the default route
+// for the lowest-numbered family requested (IPv4 if wantV4, else IPv6),
+// along with whichever of its addresses wantV4/wantV6 asked for.
+func getDefaultRouteInterface(wantV4, wantV6 bool) (*net.Interface, net.IP, net.IP, error) {
+	family := netlink.FAMILY_V4
+	if !wantV4 && wantV6 {
+		family = netlink.FAMILY_V6
+	}
+
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+
+		iface, err := net.InterfaceByIndex(route.LinkIndex)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to look up default route interface: %v", err)
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		v4, v6, err := usableAddrs(addrs, wantV4, wantV6)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("default route interface %v: %v", iface.Name, err)
+		}
+
+		return iface, v4, v6, nil
+	}
+
+	return nil, nil, nil, fmt.Errorf("unable to find default route interface")
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"net"
+	"testing"
+)
+
+func addr(cidr string) net.Addr {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ipnet.IP = ip
+	return ipnet
+}
+
+func TestUsableAddrsPicksV4AndV6(t *testing.T) {
+	addrs := []net.Addr{
+		addr("fe80::1/64"),      // link-local, not global unicast
+		addr("2001:db8::1/64"),  // global unicast v6
+		addr("127.0.0.1/8"),     // loopback
+		addr("192.168.1.5/24"),  // usable v4
+	}
+
+	v4, v6, err := usableAddrs(addrs, true, true)
+	if err != nil {
+		t.Fatalf("usableAddrs: %v", err)
+	}
+	if v4.String() != "192.168.1.5" {
+		t.Errorf("v4 = %v, want 192.168.1.5", v4)
+	}
+	if v6.String() != "2001:db8::1" {
+		t.Errorf("v6 = %v, want 2001:db8::1", v6)
+	}
+}
+
+func TestUsableAddrsV6OnlyDoesNotRequireV4(t *testing.T) {
+	addrs := []net.Addr{addr("2001:db8::1/64")}
+
+	v4, v6, err := usableAddrs(addrs, false, true)
+	if err != nil {
+		t.Fatalf("usableAddrs: %v", err)
+	}
+	if v4 != nil {
+		t.Errorf("v4 = %v, want nil", v4)
+	}
+	if v6.String() != "2001:db8::1" {
+		t.Errorf("v6 = %v, want 2001:db8::1", v6)
+	}
+}
+
+func TestUsableAddrsMissingRequiredFamily(t *testing.T) {
+	addrs := []net.Addr{addr("2001:db8::1/64")}
+
+	if _, _, err := usableAddrs(addrs, true, true); err == nil {
+		t.Fatal("expected an error when no IPv4 address is present but wantV4 is set")
+	}
+}
+
+func TestUsableAddrsSkipsLinkLocalV6(t *testing.T) {
+	addrs := []net.Addr{addr("fe80::1/64"), addr("10.0.0.1/24")}
+
+	_, v6, err := usableAddrs(addrs, true, true)
+	if err == nil {
+		t.Fatalf("expected an error since only a link-local IPv6 address is present, got v6=%v", v6)
+	}
+}